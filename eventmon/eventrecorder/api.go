@@ -0,0 +1,122 @@
+package eventrecorder
+
+import (
+	"crypto/x509"
+	"os"
+	"time"
+
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
+)
+
+// EventType describes a single SSH or X.509 certificate issuance event.
+type EventType struct {
+	CreateTime      uint64
+	LifetimeSeconds uint32
+	Ssh             bool
+	X509            bool
+}
+
+type eventType struct {
+	EventType
+	older *eventType
+	newer *eventType
+}
+
+type eventsListType struct {
+	oldest *eventType
+	newest *eventType
+}
+
+// EventsMap is the gob-serializable form of the recorded event history, as
+// loaded from and saved to disk.
+type EventsMap map[string][]EventType
+
+// Events is the reply sent over RequestEventsChannel.
+type Events struct {
+	ComputeDuration time.Duration
+	Events          map[string][]EventType
+}
+
+// UserIssuance is one entry of a TopUsersByIssuance result.
+type UserIssuance struct {
+	Username string
+	Count    int
+}
+
+// EventRecorder records SSH and X.509 certificate issuance events per user,
+// expires old events, persists them to disk, and exposes them as
+// Prometheus metrics.
+type EventRecorder struct {
+	filename             string
+	logger               log.Logger
+	eventsMap            map[string]*eventsListType
+	RequestEventsChannel chan<- chan<- Events
+	SshCertChannel       chan<- *ssh.Certificate
+	X509CertChannel      chan<- *x509.Certificate
+
+	queryChannel chan<- func()
+
+	// journalFile, journalEntries and nextJournalSeq are only touched from
+	// the eventLoop goroutine: recordEvent appends to journalFile, and
+	// compact replaces it with a fresh, empty one after folding it into a
+	// snapshot. nextJournalSeq is the sequence number the next journal
+	// entry will be stamped with; it only ever increases, including across
+	// a resetJournal, so the watermark saved in a snapshot unambiguously
+	// identifies which journal entries it already includes.
+	journalFile    *os.File
+	journalEntries int
+	nextJournalSeq uint64
+
+	issuedTotal  *prometheus.CounterVec
+	certLifetime prometheus.Histogram
+}
+
+// New creates an EventRecorder that loads any previously persisted events
+// from filename and begins recording new ones.
+func New(filename string, logger log.Logger) (*EventRecorder, error) {
+	return newEventRecorder(filename, logger)
+}
+
+// Describe implements prometheus.Collector.
+func (sr *EventRecorder) Describe(ch chan<- *prometheus.Desc) {
+	sr.issuedTotal.Describe(ch)
+	sr.certLifetime.Describe(ch)
+	ch <- activeUsersDesc
+}
+
+// Collect implements prometheus.Collector. It can be registered directly
+// with a prometheus.Registerer and served on the existing status page HTTP
+// mux via promhttp.Handler() on "/metrics".
+//
+// That registration happens wherever keymaster's status page mux is built,
+// which isn't part of this source tree, so it's not done here: this
+// EventRecorder is ready to hand to prometheus.MustRegister as soon as that
+// construction site exists.
+func (sr *EventRecorder) Collect(ch chan<- prometheus.Metric) {
+	sr.issuedTotal.Collect(ch)
+	sr.certLifetime.Collect(ch)
+	for _, counted := range sr.activeUserCounts() {
+		ch <- prometheus.MustNewConstMetric(activeUsersDesc,
+			prometheus.GaugeValue, float64(counted.count), counted.window)
+	}
+}
+
+// TopUsersByIssuance returns the n users with the most issuance events
+// within window, most active first.
+func (sr *EventRecorder) TopUsersByIssuance(window time.Duration, n int) []UserIssuance {
+	return sr.topUsersByIssuance(window, n)
+}
+
+// IssuanceRate returns the number of certificates issued to user within
+// window, divided by window (as a Duration), i.e. issuances per second.
+func (sr *EventRecorder) IssuanceRate(user string, window time.Duration) float64 {
+	return sr.issuanceRate(user, window)
+}
+
+// TotalIssuedSince returns the number of SSH and X.509 certificates issued
+// since t, across all users.
+func (sr *EventRecorder) TotalIssuedSince(t time.Time) (ssh, x509 int) {
+	return sr.totalIssuedSince(t)
+}
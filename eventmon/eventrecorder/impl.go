@@ -2,14 +2,19 @@ package eventrecorder
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/gob"
+	"io"
+	"io/ioutil"
 	"os"
 	"syscall"
 	"time"
 
 	"github.com/Symantec/Dominator/lib/fsutil"
 	"github.com/Symantec/Dominator/lib/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -18,17 +23,27 @@ const (
 	filePerms    = syscall.S_IRUSR | syscall.S_IWUSR | syscall.S_IRGRP |
 		syscall.S_IROTH
 	durationMonth = time.Hour * 24 * 31
+
+	// journalCompactionThreshold bounds how many events may accumulate in
+	// the journal before it is folded into a fresh snapshot.
+	journalCompactionThreshold = 10000
+	compactionInterval         = time.Hour
 )
 
 func newEventRecorder(filename string, logger log.Logger) (
 	*EventRecorder, error) {
-	eventsMap, err := loadEvents(filename)
+	eventsMap, nextJournalSeq, err := loadEvents(filename)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
+	journalFile, err := openJournal(journalFilename(filename))
+	if err != nil {
+		return nil, err
+	}
 	requestEventsChannel := make(chan chan<- Events, bufferLength)
 	sshCertChannel := make(chan *ssh.Certificate, bufferLength)
 	x509CertChannel := make(chan *x509.Certificate, bufferLength)
+	queryChannel := make(chan func(), bufferLength)
 	sr := &EventRecorder{
 		filename:             filename,
 		logger:               logger,
@@ -36,73 +51,185 @@ func newEventRecorder(filename string, logger log.Logger) (
 		RequestEventsChannel: requestEventsChannel,
 		SshCertChannel:       sshCertChannel,
 		X509CertChannel:      x509CertChannel,
+		queryChannel:         queryChannel,
+		journalFile:          journalFile,
+		nextJournalSeq:       nextJournalSeq,
+		issuedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "keymaster_certs_issued_total",
+			Help: "Total number of certificates issued, by type and user.",
+		}, []string{"type", "user"}),
+		certLifetime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "keymaster_cert_lifetime_seconds",
+			Help:    "Distribution of requested certificate lifetimes.",
+			Buckets: prometheus.ExponentialBuckets(60, 4, 10),
+		}),
 	}
-	go sr.eventLoop(requestEventsChannel, sshCertChannel, x509CertChannel)
+	go sr.eventLoop(requestEventsChannel, sshCertChannel, x509CertChannel,
+		queryChannel)
 	return sr, nil
 }
 
-func loadEvents(filename string) (map[string]*eventsListType, error) {
+// journalEntry is one length-delimited, gob-encoded frame appended to the
+// journal file for every recorded event. Seq is a monotonically increasing
+// counter, unique across this journal's lifetime (it is never reset by
+// resetJournal), so a snapshot can record exactly which journal entries it
+// already folds in; see snapshotType.WatermarkSeq.
+type journalEntry struct {
+	Username string
+	Event    EventType
+	Seq      uint64
+}
+
+// snapshotType is the gob-encoded form saveSnapshot writes. WatermarkSeq is
+// the highest journalEntry.Seq already folded into Events: on load, any
+// journal entry with Seq <= WatermarkSeq is skipped, so that a crash
+// between saveSnapshot writing the snapshot and resetJournal truncating the
+// journal cannot double-count events on restart.
+type snapshotType struct {
+	Events       EventsMap
+	WatermarkSeq uint64
+}
+
+func journalFilename(filename string) string {
+	return filename + ".journal"
+}
+
+func openJournal(filename string) (*os.File, error) {
+	return os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, filePerms)
+}
+
+// loadEvents loads the most recent snapshot, then replays any journal
+// entries appended since that snapshot's watermark, and returns the
+// sequence number the next newly-journaled entry should use.
+func loadEvents(filename string) (map[string]*eventsListType, uint64, error) {
+	eventsMap := make(map[string]*eventsListType)
+	minCreateTime := uint64(time.Now().Add(-durationMonth).Unix())
+	watermarkSeq, snapshotErr := loadSnapshot(filename, eventsMap, minCreateTime)
+	if snapshotErr != nil && !os.IsNotExist(snapshotErr) {
+		return nil, 0, snapshotErr
+	}
+	maxSeq, err := loadJournal(journalFilename(filename), eventsMap,
+		minCreateTime, watermarkSeq)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	if maxSeq > watermarkSeq {
+		watermarkSeq = maxSeq
+	}
+	return eventsMap, watermarkSeq + 1, snapshotErr
+}
+
+// loadSnapshot reads a snapshot written by saveSnapshot, or (as a one-time
+// migration) one from before the journal existed: a bare gob-encoded
+// EventsMap with no watermark, which is treated as watermark 0.
+func loadSnapshot(filename string, eventsMap map[string]*eventsListType,
+	minCreateTime uint64) (uint64, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	var snapshot snapshotType
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snapshot); err != nil {
+		var events EventsMap
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&events); err != nil {
+			return 0, err
+		}
+		snapshot = snapshotType{Events: events}
+	}
+	for username, eventsSlice := range snapshot.Events {
+		for _, savedEvent := range eventsSlice {
+			appendEventToMap(eventsMap, username, savedEvent, minCreateTime)
+		}
+	}
+	return snapshot.WatermarkSeq, nil
+}
+
+// loadJournal replays length-delimited gob frames in order, skipping any
+// entry already folded into the snapshot (Seq <= watermarkSeq) so that a
+// crash between saveSnapshot and resetJournal during compaction cannot
+// double-count events. It returns the highest Seq seen, so the caller can
+// resume numbering. A truncated trailing frame (e.g. from a crash
+// mid-append) is tolerated: everything successfully decoded so far is
+// kept.
+func loadJournal(filename string, eventsMap map[string]*eventsListType,
+	minCreateTime, watermarkSeq uint64) (uint64, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		return make(map[string]*eventsListType), err
+		return watermarkSeq, err
 	}
 	defer file.Close()
 	reader := bufio.NewReader(file)
-	decoder := gob.NewDecoder(reader)
-	var events EventsMap
-	if err := decoder.Decode(&events); err != nil {
-		return nil, err
-	}
-	eventsMap := make(map[string]*eventsListType, len(events))
-	minCreateTime := uint64(time.Now().Add(-durationMonth).Unix())
-	for username, eventsSlice := range events {
-		eventsList := &eventsListType{}
-		for _, savedEvent := range eventsSlice {
-			if savedEvent.CreateTime < minCreateTime {
-				continue
-			}
-			event := &eventType{
-				EventType: savedEvent,
-				older:     eventsList.newest,
-			}
-			if eventsList.newest != nil {
-				eventsList.newest.newer = event
-			}
-			eventsList.newest = event
-			if eventsList.oldest == nil {
-				eventsList.oldest = event
-			}
+	maxSeq := watermarkSeq
+	for {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return maxSeq, nil
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return maxSeq, nil
+		}
+		var entry journalEntry
+		if err := gob.NewDecoder(bytes.NewReader(frame)).Decode(&entry); err != nil {
+			return maxSeq, nil
 		}
+		if entry.Seq > maxSeq {
+			maxSeq = entry.Seq
+		}
+		if entry.Seq <= watermarkSeq {
+			continue
+		}
+		appendEventToMap(eventsMap, entry.Username, entry.Event, minCreateTime)
+	}
+}
+
+func appendEventToMap(eventsMap map[string]*eventsListType, username string,
+	savedEvent EventType, minCreateTime uint64) {
+	if savedEvent.CreateTime < minCreateTime {
+		return
+	}
+	eventsList := eventsMap[username]
+	if eventsList == nil {
+		eventsList = &eventsListType{}
 		eventsMap[username] = eventsList
 	}
-	return eventsMap, nil
+	event := &eventType{
+		EventType: savedEvent,
+		older:     eventsList.newest,
+	}
+	if eventsList.newest != nil {
+		eventsList.newest.newer = event
+	}
+	eventsList.newest = event
+	if eventsList.oldest == nil {
+		eventsList.oldest = event
+	}
 }
 
 func (sr *EventRecorder) eventLoop(requestEventsChannel <-chan chan<- Events,
 	sshCertChannel <-chan *ssh.Certificate,
-	x509CertChannel <-chan *x509.Certificate) {
+	x509CertChannel <-chan *x509.Certificate,
+	queryChannel <-chan func()) {
 	var lastEvents *Events
 	sr.getEventsList(&lastEvents)
 	hourlyTimer := time.NewTimer(time.Hour)
-	saveTimer := time.NewTimer(time.Hour)
-	saveTimer.Stop()
+	compactionTimer := time.NewTimer(compactionInterval)
 	for {
 		select {
 		case cert := <-sshCertChannel:
-			saveTimer.Reset(time.Second * 5)
 			lastEvents = nil
 			sr.recordEvent(cert.ValidPrincipals[0],
 				time.Until(time.Unix(int64(cert.ValidBefore), 0)),
 				true, false)
+			sr.compactIfJournalFull(&lastEvents)
 		case cert := <-x509CertChannel:
-			saveTimer.Reset(time.Second * 5)
 			lastEvents = nil
 			sr.recordEvent(cert.Subject.CommonName, time.Until(cert.NotAfter),
 				false, true)
+			sr.compactIfJournalFull(&lastEvents)
 		case <-hourlyTimer.C:
 			hourlyTimer.Reset(time.Hour)
 			if sr.expireOldEvents() {
-				saveTimer.Reset(time.Second * 5)
 				lastEvents = nil
 			}
 		case replyChannel := <-requestEventsChannel:
@@ -110,9 +237,11 @@ func (sr *EventRecorder) eventLoop(requestEventsChannel <-chan chan<- Events,
 			case replyChannel <- *sr.getEventsList(&lastEvents):
 			default:
 			}
-		case <-saveTimer.C:
-			sr.getEventsList(&lastEvents)
-			if err := saveEvents(sr.filename, lastEvents.Events); err != nil {
+		case query := <-queryChannel:
+			query()
+		case <-compactionTimer.C:
+			compactionTimer.Reset(compactionInterval)
+			if err := sr.compact(&lastEvents); err != nil {
 				sr.logger.Println(err)
 			}
 		}
@@ -135,27 +264,26 @@ func (sr *EventRecorder) recordEvent(username string, lifetime time.Duration,
 			lifetimeSeconds = minutesPlus * 60
 		}
 	}
-	eventsList := sr.eventsMap[username]
-	if eventsList == nil {
-		eventsList = &eventsListType{}
-		sr.eventsMap[username] = eventsList
+	if ssh {
+		sr.issuedTotal.WithLabelValues("ssh", username).Inc()
 	}
-	event := &eventType{
-		EventType: EventType{
-			CreateTime:      uint64(time.Now().Unix()),
-			LifetimeSeconds: lifetimeSeconds,
-			Ssh:             ssh,
-			X509:            x509,
-		},
-		older: eventsList.newest,
+	if x509 {
+		sr.issuedTotal.WithLabelValues("x509", username).Inc()
 	}
-	if eventsList.newest != nil {
-		eventsList.newest.newer = event
+	sr.certLifetime.Observe(float64(lifetimeSeconds))
+	savedEvent := EventType{
+		CreateTime:      uint64(time.Now().Unix()),
+		LifetimeSeconds: lifetimeSeconds,
+		Ssh:             ssh,
+		X509:            x509,
 	}
-	eventsList.newest = event
-	if eventsList.oldest == nil {
-		eventsList.oldest = event
+	appendEventToMap(sr.eventsMap, username, savedEvent, 0)
+	if err := sr.appendJournalEntry(username, savedEvent); err != nil {
+		sr.logger.Println(err)
+		return
 	}
+	sr.journalEntries++
+	sr.nextJournalSeq++
 }
 
 func (sr *EventRecorder) getEventsList(lastEvents **Events) *Events {
@@ -175,7 +303,12 @@ func (sr *EventRecorder) getEventsList(lastEvents **Events) *Events {
 	return *lastEvents
 }
 
-func saveEvents(filename string, eventsMap EventsMap) error {
+// saveSnapshot gob-encodes the full eventsMap, tagged with the journal
+// watermark it already includes, and renames it into place atomically. It
+// is only called by compact, periodically or once the journal holds
+// journalCompactionThreshold entries, rather than a few seconds after any
+// new event as before.
+func saveSnapshot(filename string, eventsMap EventsMap, watermarkSeq uint64) error {
 	file, err := fsutil.CreateRenamingWriter(filename, filePerms)
 	if err != nil {
 		return err
@@ -184,9 +317,71 @@ func saveEvents(filename string, eventsMap EventsMap) error {
 	writer := bufio.NewWriter(file)
 	defer writer.Flush()
 	encoder := gob.NewEncoder(writer)
-	if err := encoder.Encode(eventsMap); err != nil {
+	snapshot := snapshotType{Events: eventsMap, WatermarkSeq: watermarkSeq}
+	if err := encoder.Encode(snapshot); err != nil {
+		return err
+	}
+	return nil
+}
+
+// appendJournalEntry appends a single length-delimited gob frame to the
+// journal and fsyncs it, an O(1) write regardless of how many events have
+// been recorded so far.
+func (sr *EventRecorder) appendJournalEntry(username string, event EventType) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(journalEntry{
+		Username: username,
+		Event:    event,
+		Seq:      sr.nextJournalSeq,
+	}); err != nil {
+		return err
+	}
+	if err := binary.Write(sr.journalFile, binary.BigEndian, uint32(buf.Len())); err != nil {
+		return err
+	}
+	if _, err := sr.journalFile.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return sr.journalFile.Sync()
+}
+
+func (sr *EventRecorder) compactIfJournalFull(lastEvents **Events) {
+	if sr.journalEntries < journalCompactionThreshold {
+		return
+	}
+	if err := sr.compact(lastEvents); err != nil {
+		sr.logger.Println(err)
+	}
+}
+
+// compact writes a fresh snapshot of the current in-memory state, tagged
+// with the journal watermark it already includes, and truncates the
+// journal, folding it into that snapshot. This is the only place a full
+// rewrite of all events happens. Tagging the snapshot with its watermark,
+// rather than relying on the truncation happening right after the write,
+// means a crash between the two steps just leaves a journal whose entries
+// are all at or below the watermark: loadJournal skips them on restart
+// instead of replaying them a second time.
+func (sr *EventRecorder) compact(lastEvents **Events) error {
+	events := sr.getEventsList(lastEvents)
+	watermarkSeq := sr.nextJournalSeq - 1
+	if err := saveSnapshot(sr.filename, events.Events, watermarkSeq); err != nil {
+		return err
+	}
+	return sr.resetJournal()
+}
+
+func (sr *EventRecorder) resetJournal() error {
+	if err := sr.journalFile.Close(); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(journalFilename(sr.filename),
+		os.O_TRUNC|os.O_CREATE|os.O_WRONLY, filePerms)
+	if err != nil {
 		return err
 	}
+	sr.journalFile = file
+	sr.journalEntries = 0
 	return nil
 }
 
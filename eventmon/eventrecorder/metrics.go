@@ -0,0 +1,116 @@
+package eventrecorder
+
+import (
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var activeUsersDesc = prometheus.NewDesc(
+	"keymaster_active_users",
+	"Number of distinct users with an issuance event within window.",
+	[]string{"window"}, nil)
+
+type activeUserCount struct {
+	window string
+	count  int
+}
+
+// query runs fn on the eventLoop goroutine and waits for it to finish, so
+// that reads of sr.eventsMap are never concurrent with the writes eventLoop
+// makes in recordEvent and expireOldEvents.
+func (sr *EventRecorder) query(fn func()) {
+	done := make(chan struct{})
+	sr.queryChannel <- func() {
+		fn()
+		close(done)
+	}
+	<-done
+}
+
+// activeUserCounts avoids rebuilding the full per-user event slice snapshot
+// that getEventsList produces: it walks sr.eventsMap directly and only
+// looks at each user's most recent event.
+func (sr *EventRecorder) activeUserCounts() []activeUserCount {
+	counts := []activeUserCount{
+		{window: "24h"}, {window: "7d"}, {window: "30d"},
+	}
+	sr.query(func() {
+		now := time.Now()
+		for _, eventsList := range sr.eventsMap {
+			if eventsList.newest == nil {
+				continue
+			}
+			age := now.Sub(time.Unix(int64(eventsList.newest.CreateTime), 0))
+			switch {
+			case age <= 24*time.Hour:
+				counts[0].count++
+				counts[1].count++
+				counts[2].count++
+			case age <= 7*24*time.Hour:
+				counts[1].count++
+				counts[2].count++
+			case age <= 30*24*time.Hour:
+				counts[2].count++
+			}
+		}
+	})
+	return counts
+}
+
+func (sr *EventRecorder) topUsersByIssuance(window time.Duration, n int) []UserIssuance {
+	var result []UserIssuance
+	sr.query(func() {
+		cutoff := uint64(time.Now().Add(-window).Unix())
+		result = make([]UserIssuance, 0, len(sr.eventsMap))
+		for username, eventsList := range sr.eventsMap {
+			count := 0
+			for event := eventsList.newest; event != nil && event.CreateTime >= cutoff; event = event.older {
+				count++
+			}
+			if count > 0 {
+				result = append(result, UserIssuance{Username: username, Count: count})
+			}
+		}
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Count > result[j].Count
+	})
+	if n >= 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+func (sr *EventRecorder) issuanceRate(user string, window time.Duration) float64 {
+	var count int
+	sr.query(func() {
+		eventsList := sr.eventsMap[user]
+		if eventsList == nil {
+			return
+		}
+		cutoff := uint64(time.Now().Add(-window).Unix())
+		for event := eventsList.newest; event != nil && event.CreateTime >= cutoff; event = event.older {
+			count++
+		}
+	})
+	return float64(count) / window.Seconds()
+}
+
+func (sr *EventRecorder) totalIssuedSince(t time.Time) (ssh, x509 int) {
+	sr.query(func() {
+		cutoff := uint64(t.Unix())
+		for _, eventsList := range sr.eventsMap {
+			for event := eventsList.newest; event != nil && event.CreateTime >= cutoff; event = event.older {
+				if event.Ssh {
+					ssh++
+				}
+				if event.X509 {
+					x509++
+				}
+			}
+		}
+	})
+	return ssh, x509
+}
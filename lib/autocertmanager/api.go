@@ -0,0 +1,88 @@
+package autocertmanager
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/keymaster/lib/util/filewatcher"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Config holds the operator-supplied settings for running keymaster's own
+// TLS listener in ACME/autocert mode, so a public-facing instance does not
+// require a manually provisioned server certificate.
+type Config struct {
+	// Hostnames lists the public hostnames autocert is allowed to fetch
+	// certificates for.
+	Hostnames []string
+	// CacheDir is where autocert persists issued certificates and account
+	// keys between restarts.
+	CacheDir string
+	// Email is passed to the ACME CA as the registration contact.
+	Email string
+	// DirectoryURL overrides the default Let's Encrypt directory, so
+	// staging or a private ACME CA (Smallstep, Vault PKI) can be used.
+	DirectoryURL string
+	// OverrideCertFile and OverrideKeyFile, if both set, pin a specific
+	// certificate (e.g. for an internal-only SAN) ahead of ACME. The pair
+	// is reloaded, using the same file watcher as the htpasswd backend,
+	// whenever OverrideCertFile changes, so replacing them does not require
+	// a restart. OverrideKeyFile is not watched: a change to it alone is
+	// only picked up at the next change to OverrideCertFile.
+	OverrideCertFile string
+	OverrideKeyFile  string
+	// PollInterval is the fallback poll interval for the override
+	// certificate's file watcher. Zero selects
+	// filewatcher.DefaultPollInterval.
+	PollInterval time.Duration
+}
+
+// Manager serves keymaster's own TLS certificate in ACME/autocert mode,
+// optionally composed with a statically-configured override certificate
+// pinned for an internal SAN.
+//
+// Wiring GetCertificate into tls.Config.GetCertificate and HTTPHandler into
+// the :80 listener both happen at keymaster server startup, which isn't
+// part of this source tree; this package is ready to call as soon as that
+// startup code exists.
+type Manager struct {
+	config          Config
+	logger          log.DebugLogger
+	autocertManager *autocert.Manager
+	overrideWatcher *filewatcher.Watcher
+
+	rwMutex       sync.RWMutex
+	overrideCert  *tls.Certificate
+	overrideNames []string
+}
+
+// New creates a Manager from config. If config.OverrideCertFile is set it
+// is loaded (and its watcher started) before New returns.
+func New(config Config, logger log.DebugLogger) (*Manager, error) {
+	return newManager(config, logger)
+}
+
+// GetCertificate is suitable for use as tls.Config.GetCertificate. It
+// serves the override certificate for any hostname it covers, and falls
+// back to ACME/autocert for everything else.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.getCertificate(hello)
+}
+
+// HTTPHandler serves ACME HTTP-01 challenges on
+// "/.well-known/acme-challenge/" and redirects every other request to
+// HTTPS. It is meant to be served on :80 alongside the HTTPS listener.
+func (m *Manager) HTTPHandler() http.Handler {
+	return m.autocertManager.HTTPHandler(http.HandlerFunc(redirectToHTTPS))
+}
+
+// Close stops the override certificate's file watcher, if any.
+func (m *Manager) Close() error {
+	if m.overrideWatcher == nil {
+		return nil
+	}
+	return m.overrideWatcher.Close()
+}
@@ -0,0 +1,90 @@
+package autocertmanager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/keymaster/lib/util/filewatcher"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func newManager(config Config, logger log.DebugLogger) (*Manager, error) {
+	autocertManager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(config.Hostnames...),
+		Cache:      autocert.DirCache(config.CacheDir),
+		Email:      config.Email,
+	}
+	if config.DirectoryURL != "" {
+		autocertManager.Client = &acme.Client{DirectoryURL: config.DirectoryURL}
+	}
+	m := &Manager{
+		config:          config,
+		logger:          logger,
+		autocertManager: autocertManager,
+	}
+	if config.OverrideCertFile == "" {
+		return m, nil
+	}
+	if err := m.reloadOverride(); err != nil {
+		return nil, err
+	}
+	watcher, err := filewatcher.New(config.OverrideCertFile, config.PollInterval,
+		m.reloadOverride, logger)
+	if err != nil {
+		return nil, err
+	}
+	m.overrideWatcher = watcher
+	return m, nil
+}
+
+// reloadOverride is the filewatcher.ReloadFunc for the override
+// certificate: on error it keeps serving whatever was loaded before.
+func (m *Manager) reloadOverride() error {
+	cert, err := tls.LoadX509KeyPair(m.config.OverrideCertFile, m.config.OverrideKeyFile)
+	if err != nil {
+		if m.logger != nil {
+			m.logger.Printf("autocertmanager: keeping previous override certificate, failed to reload %s: %s\n",
+				m.config.OverrideCertFile, err)
+		}
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		if m.logger != nil {
+			m.logger.Printf("autocertmanager: keeping previous override certificate, failed to parse %s: %s\n",
+				m.config.OverrideCertFile, err)
+		}
+		return err
+	}
+	names := leaf.DNSNames
+	if leaf.Subject.CommonName != "" {
+		names = append(names, leaf.Subject.CommonName)
+	}
+	m.rwMutex.Lock()
+	m.overrideCert = &cert
+	m.overrideNames = names
+	m.rwMutex.Unlock()
+	return nil
+}
+
+func (m *Manager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.rwMutex.RLock()
+	cert := m.overrideCert
+	names := m.overrideNames
+	m.rwMutex.RUnlock()
+	for _, name := range names {
+		if name == hello.ServerName {
+			return cert, nil
+		}
+	}
+	return m.autocertManager.GetCertificate(hello)
+}
+
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	target := "https://" + r.Host + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
@@ -0,0 +1,104 @@
+package certauth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"sync"
+	"time"
+
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/keymaster/eventmon/eventrecorder"
+	"github.com/Symantec/keymaster/lib/util/filewatcher"
+)
+
+// Config holds the operator-supplied settings for a CertAuthenticator.
+type Config struct {
+	// CAFilename is a PEM bundle of CAs trusted to sign end-user client
+	// certificates. It is hot-reloaded, so rotating it does not require a
+	// keymaster restart.
+	CAFilename string
+	// CRLFilename, if set, is a PEM or DER CRL checked on every
+	// authentication. It is also hot-reloaded.
+	CRLFilename string
+	// OCSPServer, if set, is queried for certificates not covered by the
+	// CRL. Responses are cached in memory until their NextUpdate.
+	OCSPServer string
+	// RequireClientAuthEKU rejects certificates that do not assert the
+	// clientAuth extended key usage.
+	RequireClientAuthEKU bool
+	// AllowedIssuers, if non-empty, restricts accepted certificates to
+	// those signed by one of these issuer common names.
+	AllowedIssuers []string
+	// AllowedSubjectPatterns, if non-empty, restricts accepted
+	// certificates to those whose subject CN or OU match one of these
+	// path.Match-style glob patterns.
+	AllowedSubjectPatterns []string
+	// PollInterval is the fallback poll interval used by the CA/CRL file
+	// watchers when a filesystem watch cannot be installed. Zero selects
+	// filewatcher.DefaultPollInterval.
+	PollInterval time.Duration
+}
+
+type ocspCacheEntry struct {
+	good       bool
+	nextUpdate time.Time
+}
+
+// CertAuthenticator authenticates end users by the X.509 client certificate
+// presented during the TLS handshake on the keymaster login endpoint. It is
+// composable with password authenticators: a valid client cert bypasses
+// password entry and goes straight into the normal signing flow, while the
+// absence of a cert, or an invalid one, falls back to the password form.
+//
+// That composition, and registering ClientCAPool on the login endpoint's
+// tls.Config, both happen at keymaster's HTTP server construction site,
+// which isn't part of this source tree; this package is a standalone,
+// ready-to-call authenticator pending that wiring.
+type CertAuthenticator struct {
+	config        Config
+	logger        log.DebugLogger
+	eventRecorder *eventrecorder.EventRecorder
+	caWatcher     *filewatcher.Watcher
+	crlWatcher    *filewatcher.Watcher
+
+	rwMutex   sync.RWMutex
+	roots     *x509.CertPool
+	caCerts   []*x509.Certificate // same CAs as roots, kept individually so reloadCRL can check the CRL's signature
+	crl       *pkix.CertificateList
+	ocspCache map[string]ocspCacheEntry // certificate serial (hex) -> entry
+}
+
+// New creates a CertAuthenticator from config. The CA pool (and CRL, if
+// configured) are loaded immediately and then hot-reloaded in the
+// background.
+func New(config Config, eventRecorder *eventrecorder.EventRecorder,
+	logger log.DebugLogger) (*CertAuthenticator, error) {
+	return newCertAuthenticator(config, eventRecorder, logger)
+}
+
+// ClientCAPool returns the currently loaded CA pool, suitable for use as
+// tls.Config.ClientCAs alongside tls.Config.ClientAuth set to
+// VerifyClientCertIfGiven.
+func (ca *CertAuthenticator) ClientCAPool() *x509.CertPool {
+	ca.rwMutex.RLock()
+	defer ca.rwMutex.RUnlock()
+	return ca.roots
+}
+
+// Authenticate verifies the certificate chain presented by the client
+// (chain[0] is the leaf), checks it against the CRL/OCSP responder and the
+// allowlists in Config, and returns the username extracted from the
+// certificate. On success it records a synthetic issuance event so existing
+// history/expiry telemetry keeps working.
+func (ca *CertAuthenticator) Authenticate(chain []*x509.Certificate) (
+	username string, valid bool, err error) {
+	return ca.authenticate(chain)
+}
+
+// Close stops the background CA/CRL file watchers.
+func (ca *CertAuthenticator) Close() error {
+	if ca.crlWatcher != nil {
+		ca.crlWatcher.Close()
+	}
+	return ca.caWatcher.Close()
+}
@@ -0,0 +1,367 @@
+package certauth
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/keymaster/eventmon/eventrecorder"
+	"github.com/Symantec/keymaster/lib/util/filewatcher"
+	"golang.org/x/crypto/ocsp"
+)
+
+var (
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidUPN            = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+
+	errNoCert          = errors.New("certauth: no client certificate presented")
+	errUntrustedChain  = errors.New("certauth: certificate does not chain to a trusted CA")
+	errRevoked         = errors.New("certauth: certificate is revoked")
+	errMissingEKU      = errors.New("certauth: certificate is missing the clientAuth EKU")
+	errDisallowed      = errors.New("certauth: certificate issuer or subject is not allowlisted")
+	errBadCRLSignature = errors.New("certauth: CRL signature does not verify against any loaded CA")
+)
+
+func newCertAuthenticator(config Config, eventRecorder *eventrecorder.EventRecorder,
+	logger log.DebugLogger) (*CertAuthenticator, error) {
+	ca := &CertAuthenticator{
+		config:        config,
+		logger:        logger,
+		eventRecorder: eventRecorder,
+		ocspCache:     make(map[string]ocspCacheEntry),
+	}
+	if err := ca.reloadCAPool(); err != nil {
+		return nil, err
+	}
+	caWatcher, err := filewatcher.New(config.CAFilename, config.PollInterval,
+		ca.reloadCAPool, logger)
+	if err != nil {
+		return nil, err
+	}
+	ca.caWatcher = caWatcher
+	if config.CRLFilename != "" {
+		if err := ca.reloadCRL(); err != nil {
+			return nil, err
+		}
+		crlWatcher, err := filewatcher.New(config.CRLFilename, config.PollInterval,
+			ca.reloadCRL, logger)
+		if err != nil {
+			return nil, err
+		}
+		ca.crlWatcher = crlWatcher
+	}
+	return ca, nil
+}
+
+func (ca *CertAuthenticator) reloadCAPool() error {
+	pemBytes, err := ioutil.ReadFile(ca.config.CAFilename)
+	if err != nil {
+		if ca.logger != nil {
+			ca.logger.Printf("certauth: keeping previous CA pool, failed to reload %s: %s\n",
+				ca.config.CAFilename, err)
+		}
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		err := fmt.Errorf("%s: no certificates found", ca.config.CAFilename)
+		if ca.logger != nil {
+			ca.logger.Printf("certauth: keeping previous CA pool: %s\n", err)
+		}
+		return err
+	}
+	caCerts, err := parseCACerts(pemBytes)
+	if err != nil {
+		if ca.logger != nil {
+			ca.logger.Printf("certauth: keeping previous CA pool, failed to parse %s: %s\n",
+				ca.config.CAFilename, err)
+		}
+		return err
+	}
+	ca.rwMutex.Lock()
+	ca.roots = pool
+	ca.caCerts = caCerts
+	ca.rwMutex.Unlock()
+	return nil
+}
+
+// parseCACerts returns every certificate in pemBytes as a *x509.Certificate,
+// so reloadCRL can check a CRL's signature against each one in turn:
+// x509.CertPool (built alongside this by reloadCAPool) only exposes
+// opaque matching via Verify, not the certificates themselves.
+func parseCACerts(pemBytes []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+func (ca *CertAuthenticator) reloadCRL() error {
+	der, err := ioutil.ReadFile(ca.config.CRLFilename)
+	if err != nil {
+		if ca.logger != nil {
+			ca.logger.Printf("certauth: keeping previous CRL, failed to reload %s: %s\n",
+				ca.config.CRLFilename, err)
+		}
+		return err
+	}
+	crl, err := x509.ParseCRL(der)
+	if err != nil {
+		if ca.logger != nil {
+			ca.logger.Printf("certauth: keeping previous CRL, failed to parse %s: %s\n",
+				ca.config.CRLFilename, err)
+		}
+		return err
+	}
+	// x509.ParseCRL only parses the CRL, it does not check its signature,
+	// so a corrupted or substituted CRL file would otherwise be trusted as
+	// revocation gospel. Verify it against whichever loaded CA actually
+	// signed it before accepting it.
+	ca.rwMutex.RLock()
+	caCerts := ca.caCerts
+	ca.rwMutex.RUnlock()
+	signed := false
+	for _, caCert := range caCerts {
+		if caCert.CheckCRLSignature(crl) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		if ca.logger != nil {
+			ca.logger.Printf("certauth: keeping previous CRL, rejecting %s: %s\n",
+				ca.config.CRLFilename, errBadCRLSignature)
+		}
+		return errBadCRLSignature
+	}
+	ca.rwMutex.Lock()
+	ca.crl = crl
+	ca.rwMutex.Unlock()
+	return nil
+}
+
+// extractUsername returns the UPN carried in a SAN OtherName of cert if it
+// has one, and otherwise its subject CN. There is no setting to choose
+// between the two. crypto/x509 does not expose OtherName SANs, so the
+// extension is walked by hand.
+func extractUsername(cert *x509.Certificate) (string, error) {
+	if upn, ok := extractUPN(cert); ok {
+		return upn, nil
+	}
+	if cert.Subject.CommonName == "" {
+		return "", errors.New("certauth: certificate has neither a UPN SAN nor a subject CN")
+	}
+	return cert.Subject.CommonName, nil
+}
+
+func extractUPN(cert *x509.Certificate) (string, bool) {
+	var sanExtension []byte
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidSubjectAltName) {
+			sanExtension = ext.Value
+			break
+		}
+	}
+	if sanExtension == nil {
+		return "", false
+	}
+	var seq asn1.RawValue
+	if _, err := asn1.Unmarshal(sanExtension, &seq); err != nil {
+		return "", false
+	}
+	rest := seq.Bytes
+	for len(rest) > 0 {
+		var generalName asn1.RawValue
+		var err error
+		rest, err = asn1.Unmarshal(rest, &generalName)
+		if err != nil {
+			return "", false
+		}
+		// otherName is GeneralName context tag [0], constructed.
+		if generalName.Tag != 0 || !generalName.IsCompound {
+			continue
+		}
+		var otherName struct {
+			TypeID asn1.ObjectIdentifier
+			Value  asn1.RawValue `asn1:"explicit,tag:0"`
+		}
+		if _, err := asn1.UnmarshalWithParams(generalName.FullBytes, &otherName, "tag:0"); err != nil {
+			continue
+		}
+		if otherName.TypeID.Equal(oidUPN) {
+			var upn string
+			if _, err := asn1.Unmarshal(otherName.Value.FullBytes, &upn); err == nil {
+				return upn, true
+			}
+		}
+	}
+	return "", false
+}
+
+func certHasClientAuthEKU(cert *x509.Certificate) bool {
+	for _, eku := range cert.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageClientAuth || eku == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+func (ca *CertAuthenticator) issuerAllowed(cert *x509.Certificate) bool {
+	if len(ca.config.AllowedIssuers) == 0 {
+		return true
+	}
+	for _, issuer := range ca.config.AllowedIssuers {
+		if cert.Issuer.CommonName == issuer {
+			return true
+		}
+	}
+	return false
+}
+
+func (ca *CertAuthenticator) subjectAllowed(cert *x509.Certificate) bool {
+	if len(ca.config.AllowedSubjectPatterns) == 0 {
+		return true
+	}
+	candidates := append([]string{cert.Subject.CommonName}, cert.Subject.OrganizationalUnit...)
+	for _, pattern := range ca.config.AllowedSubjectPatterns {
+		for _, candidate := range candidates {
+			if ok, _ := path.Match(pattern, candidate); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ca *CertAuthenticator) checkRevocation(cert, issuer *x509.Certificate) error {
+	ca.rwMutex.RLock()
+	crl := ca.crl
+	ca.rwMutex.RUnlock()
+	if crl != nil {
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return errRevoked
+			}
+		}
+	}
+	if ca.config.OCSPServer == "" || issuer == nil {
+		return nil
+	}
+	return ca.checkOCSP(cert, issuer)
+}
+
+func (ca *CertAuthenticator) checkOCSP(cert, issuer *x509.Certificate) error {
+	serialHex := cert.SerialNumber.Text(16)
+	ca.rwMutex.RLock()
+	entry, ok := ca.ocspCache[serialHex]
+	ca.rwMutex.RUnlock()
+	if ok && time.Now().Before(entry.nextUpdate) {
+		if !entry.good {
+			return errRevoked
+		}
+		return nil
+	}
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return err
+	}
+	httpResponse, err := http.Post(ca.config.OCSPServer, "application/ocsp-request",
+		bytes.NewReader(request))
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	body, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	// Passing issuer here is required: ocsp.ParseResponse only checks the
+	// response's signature when given a non-nil issuer, and an unverified
+	// response lets anyone who can reach or MITM OCSPServer forge a "Good"
+	// status for a revoked certificate.
+	response, err := ocsp.ParseResponse(body, issuer)
+	if err != nil {
+		return err
+	}
+	good := response.Status == ocsp.Good
+	ca.rwMutex.Lock()
+	ca.ocspCache[serialHex] = ocspCacheEntry{good: good, nextUpdate: response.NextUpdate}
+	ca.rwMutex.Unlock()
+	if !good {
+		return errRevoked
+	}
+	return nil
+}
+
+func (ca *CertAuthenticator) authenticate(chain []*x509.Certificate) (
+	username string, valid bool, err error) {
+	if len(chain) == 0 {
+		return "", false, errNoCert
+	}
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	ca.rwMutex.RLock()
+	roots := ca.roots
+	ca.rwMutex.RUnlock()
+	verifiedChains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("%w: %s", errUntrustedChain, err)
+	}
+	if ca.config.RequireClientAuthEKU && !certHasClientAuthEKU(leaf) {
+		return "", false, errMissingEKU
+	}
+	if !ca.issuerAllowed(leaf) || !ca.subjectAllowed(leaf) {
+		return "", false, errDisallowed
+	}
+	// The verified chain, not the raw presented chain, tells us who
+	// actually signed leaf: Verify builds the real path from Roots and
+	// Intermediates regardless of what order the client sent its
+	// certificates in, so chain[1] is not reliable here.
+	var issuer *x509.Certificate
+	if verified := verifiedChains[0]; len(verified) > 1 {
+		issuer = verified[1]
+	}
+	if err := ca.checkRevocation(leaf, issuer); err != nil {
+		return "", false, err
+	}
+	username, err = extractUsername(leaf)
+	if err != nil {
+		return "", false, err
+	}
+	if ca.eventRecorder != nil {
+		select {
+		case ca.eventRecorder.X509CertChannel <- leaf:
+		default:
+		}
+	}
+	return username, true, nil
+}
@@ -0,0 +1,49 @@
+package htpasswd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/keymaster/lib/util/filewatcher"
+)
+
+// PasswordAuthenticator authenticates users against an htpasswd-style file
+// (lines of "username:bcrypt-hash", "#" comments and blank lines ignored).
+// It is intended as a local fallback authentication backend for break-glass
+// admin accounts when LDAP is unreachable, and autoreloads the file so
+// credentials can be rotated without restarting keymaster.
+//
+// This package is a standalone backend: listing it in keymaster's config
+// alongside the LDAP backend, so ops can actually select it, requires a
+// multi-backend construction site in keymaster's server/config package.
+// That package isn't part of this source tree, so that wiring is a
+// follow-up once it is.
+type PasswordAuthenticator struct {
+	filename string
+	logger   log.DebugLogger
+	watcher  *filewatcher.Watcher
+	rwMutex  sync.RWMutex
+	entries  map[string]string // username -> bcrypt hash
+}
+
+// New creates a PasswordAuthenticator that loads credentials from filename
+// and keeps them up to date using a filewatcher.Watcher. If pollInterval is
+// zero, filewatcher.DefaultPollInterval is used as the polling fallback when
+// a filesystem watch cannot be installed.
+func New(filename string, pollInterval time.Duration,
+	logger log.DebugLogger) (*PasswordAuthenticator, error) {
+	return newAuthenticator(filename, pollInterval, logger)
+}
+
+// PasswordAuthenticate checks username and password against the loaded
+// htpasswd file.
+func (pa *PasswordAuthenticator) PasswordAuthenticate(username string,
+	password []byte) (valid bool, err error) {
+	return pa.passwordAuthenticate(username, password)
+}
+
+// Close stops the background file watcher.
+func (pa *PasswordAuthenticator) Close() error {
+	return pa.watcher.Close()
+}
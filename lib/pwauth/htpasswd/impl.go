@@ -0,0 +1,98 @@
+package htpasswd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/keymaster/lib/util/filewatcher"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against whenever username is not found, so that a
+// lookup for an unknown user takes about as long as one for a known user
+// instead of returning early.
+const dummyHash = "$2a$10$CwTycUXWue0Thq9StjUM0uJ8vsd5KuY.z.Q9cB4ZdWtmJj8KFOeSa"
+
+func newAuthenticator(filename string, pollInterval time.Duration,
+	logger log.DebugLogger) (*PasswordAuthenticator, error) {
+	pa := &PasswordAuthenticator{
+		filename: filename,
+		logger:   logger,
+	}
+	if err := pa.reload(); err != nil {
+		return nil, err
+	}
+	watcher, err := filewatcher.New(filename, pollInterval, pa.reload, logger)
+	if err != nil {
+		return nil, err
+	}
+	pa.watcher = watcher
+	return pa, nil
+}
+
+func parseHtpasswdFile(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: missing ':' separator", filename, lineNum)
+		}
+		entries[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// reload is the filewatcher.ReloadFunc: on a parse error it logs a warning
+// and leaves the previously loaded entries in place, it never invalidates a
+// working set of credentials because of a transient bad write.
+func (pa *PasswordAuthenticator) reload() error {
+	entries, err := parseHtpasswdFile(pa.filename)
+	if err != nil {
+		if pa.logger != nil {
+			pa.logger.Printf("htpasswd: keeping previously loaded credentials, failed to reload %s: %s\n",
+				pa.filename, err)
+		}
+		return err
+	}
+	pa.rwMutex.Lock()
+	pa.entries = entries
+	pa.rwMutex.Unlock()
+	return nil
+}
+
+func (pa *PasswordAuthenticator) passwordAuthenticate(username string,
+	password []byte) (valid bool, err error) {
+	pa.rwMutex.RLock()
+	hash, ok := pa.entries[username]
+	pa.rwMutex.RUnlock()
+	if !ok {
+		hash = dummyHash
+	}
+	// bcrypt.CompareHashAndPassword runs in constant time with respect to
+	// password, so comparing against dummyHash for an unknown username
+	// keeps timing indistinguishable from a real, failed comparison.
+	err = bcrypt.CompareHashAndPassword([]byte(hash), password)
+	if !ok || err != nil {
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,90 @@
+package tokenmanager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/keymaster/lib/simplestorage"
+)
+
+// Kind distinguishes the categories of token a Manager issues.
+type Kind int
+
+const (
+	Session Kind = iota
+	CSRF
+)
+
+const (
+	// DefaultSessionTTL is used for an ordinary login.
+	DefaultSessionTTL = time.Hour * 24
+	// DefaultRememberMeTTL is used when the user opts into "stay logged
+	// in" at login time.
+	DefaultRememberMeTTL = time.Hour * 24 * 30
+
+	sweepInterval = time.Minute * 5
+)
+
+type tokenIndexEntry struct {
+	userID     string
+	kind       Kind
+	expiration time.Time
+}
+
+// Manager issues and validates session and CSRF tokens, persisting them to
+// a simplestorage.SimpleStore (the same interface the ldap password cache
+// uses) so that, unlike keymaster's previous in-process session map, they
+// survive a restart. Tokens are 256-bit random values; only sha256(token)
+// is ever written to storage, so a copy of the database is not by itself a
+// usable credential.
+type Manager struct {
+	storage      simplestorage.SimpleStore
+	logger       log.DebugLogger
+	rwMutex      sync.RWMutex
+	index        map[string]tokenIndexEntry     // sha256(token) hex -> entry
+	userTokens   map[string]map[string]struct{} // userID -> set of token hashes
+	closeChannel chan struct{}
+
+	// userIndexLocks stripes a fixed set of mutexes by userID, serializing
+	// each user's load-modify-save round trip to their durable per-user
+	// index (see addToUserIndex) without making unrelated users contend
+	// with each other.
+	userIndexLocks [userIndexLockStripes]sync.Mutex
+}
+
+// New creates a Manager backed by storage and starts its background
+// expiration sweep, which runs every 5 minutes and after every Create.
+func New(storage simplestorage.SimpleStore, logger log.DebugLogger) *Manager {
+	return newManager(storage, logger)
+}
+
+// Create issues a new token of the given kind for userID, valid for ttl,
+// and returns it. Only the token's hash is persisted to storage.
+func (m *Manager) Create(userID string, kind Kind, ttl time.Duration) (
+	token string, err error) {
+	return m.create(userID, kind, ttl)
+}
+
+// Check looks up token and returns the userID it was issued to, provided it
+// is of the given kind and has not expired.
+func (m *Manager) Check(token string, kind Kind) (userID string, ok bool) {
+	return m.check(token, kind)
+}
+
+// Delete immediately invalidates token.
+func (m *Manager) Delete(token string) error {
+	return m.delete(token)
+}
+
+// DeleteAllForUser invalidates every token issued to userID, including
+// ones issued before this Manager was created, forcing logout on all of
+// the user's sessions.
+func (m *Manager) DeleteAllForUser(userID string) error {
+	return m.deleteAllForUser(userID)
+}
+
+// Close stops the background expiration sweep.
+func (m *Manager) Close() {
+	close(m.closeChannel)
+}
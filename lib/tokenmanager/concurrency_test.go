@@ -0,0 +1,90 @@
+package tokenmanager
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStore is a minimal in-memory simplestorage.SimpleStore, sufficient
+// for exercising Manager without a real backing store.
+type fakeStore struct {
+	mu   sync.Mutex
+	data map[string]map[int][]byte
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{data: make(map[string]map[int][]byte)}
+}
+
+func (s *fakeStore) UpsertSigned(key string, dataType int, expirationUnix int64,
+	data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data[key] == nil {
+		s.data[key] = make(map[int][]byte)
+	}
+	s.data[key][dataType] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *fakeStore) GetSigned(key string, dataType int) (bool, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byType, ok := s.data[key]
+	if !ok {
+		return false, nil, nil
+	}
+	data, ok := byType[dataType]
+	if !ok {
+		return false, nil, nil
+	}
+	return true, append([]byte(nil), data...), nil
+}
+
+func (s *fakeStore) DeleteSigned(key string, dataType int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if byType, ok := s.data[key]; ok {
+		delete(byType, dataType)
+	}
+	return nil
+}
+
+// TestConcurrentCreateDoesNotDropTokensFromUserIndex reproduces the chunk0-3
+// review scenario: two Create calls for the same user racing to update the
+// durable per-user index. Before addToUserIndex was serialized per user,
+// the slower of two concurrent load-modify-save round trips would silently
+// overwrite the other's entry.
+func TestConcurrentCreateDoesNotDropTokensFromUserIndex(t *testing.T) {
+	storage := newFakeStore()
+	m := newManager(storage, nil)
+	defer m.Close()
+
+	const userID = "alice"
+	const concurrency = 20
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		kind := Session
+		if i%2 == 0 {
+			kind = CSRF
+		}
+		go func(kind Kind) {
+			defer wg.Done()
+			if _, err := m.create(userID, kind, time.Hour); err != nil {
+				t.Error(err)
+			}
+		}(kind)
+	}
+	wg.Wait()
+
+	entries, err := loadUserIndex(storage, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != concurrency {
+		t.Fatalf("durable user index has %d entries, want %d (concurrent Create calls dropped each other's token)",
+			len(entries), concurrency)
+	}
+}
@@ -0,0 +1,295 @@
+package tokenmanager
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/Symantec/Dominator/lib/log"
+	"github.com/Symantec/keymaster/lib/simplestorage"
+)
+
+const tokenBytes = 32 // 256 bits
+
+// userIndexLockStripes is the size of Manager.userIndexLocks.
+const userIndexLockStripes = 32
+
+// userIndexDataType stores, per userID, the durable list of token hashes
+// issued to them (see indexedToken/loadUserIndex/saveUserIndex). It is kept
+// in storage itself, alongside the tokens, rather than only in memory, so
+// that DeleteAllForUser still works for tokens issued before the most
+// recent restart.
+const userIndexDataType = 2
+
+// indexTTL is how long the durable per-user index entry is kept around by
+// storage. It is unrelated to any individual token's TTL: it just needs to
+// safely outlive the longest-lived token (DefaultRememberMeTTL), and is
+// rewritten (and pruned of expired tokens) on every Create.
+const indexTTL = time.Hour * 24 * 365 * 5
+
+type indexedToken struct {
+	Hash       string
+	Kind       Kind
+	Expiration int64 // Unix seconds.
+}
+
+func userIndexKey(userID string) string {
+	return "user:" + userID
+}
+
+func newManager(storage simplestorage.SimpleStore, logger log.DebugLogger) *Manager {
+	m := &Manager{
+		storage:      storage,
+		logger:       logger,
+		index:        make(map[string]tokenIndexEntry),
+		userTokens:   make(map[string]map[string]struct{}),
+		closeChannel: make(chan struct{}),
+	}
+	go m.sweepLoop()
+	return m
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func dataType(kind Kind) int {
+	if kind == CSRF {
+		return 1
+	}
+	return 0
+}
+
+func newToken() (string, error) {
+	raw := make([]byte, tokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// loadUserIndex reads the durable list of token hashes issued to userID. A
+// missing index (no tokens ever issued, or a prior process that predates
+// this index) is not an error: it is reported as an empty list.
+func loadUserIndex(storage simplestorage.SimpleStore, userID string) (
+	[]indexedToken, error) {
+	found, data, err := storage.GetSigned(userIndexKey(userID), userIndexDataType)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+	var entries []indexedToken
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func saveUserIndex(storage simplestorage.SimpleStore, userID string,
+	entries []indexedToken) error {
+	if len(entries) == 0 {
+		return storage.DeleteSigned(userIndexKey(userID), userIndexDataType)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entries); err != nil {
+		return err
+	}
+	expiration := time.Now().Add(indexTTL)
+	return storage.UpsertSigned(userIndexKey(userID), userIndexDataType,
+		expiration.Unix(), buf.Bytes())
+}
+
+// userIndexLock returns the mutex userID is striped to, so that concurrent
+// Create calls for the same user (e.g. a session and a CSRF token issued
+// back to back at login) serialize their load-modify-save round trip to
+// the durable index instead of racing to overwrite each other's entry.
+func (m *Manager) userIndexLock(userID string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return &m.userIndexLocks[h.Sum32()%userIndexLockStripes]
+}
+
+// addToUserIndex records hash in userID's durable index, pruning any
+// entries that have already expired. This is what lets deleteAllForUser
+// reach tokens issued in a previous process, the same way delete already
+// reaches them by brute-forcing storage directly (see its own comment).
+// Errors are logged rather than returned: failing to update the durable
+// index must not fail Create, since the token itself is already persisted
+// and usable.
+func (m *Manager) addToUserIndex(userID, hash string, kind Kind, expiration time.Time) {
+	lock := m.userIndexLock(userID)
+	lock.Lock()
+	defer lock.Unlock()
+	entries, err := loadUserIndex(m.storage, userID)
+	if err != nil {
+		if m.logger != nil {
+			m.logger.Printf("tokenmanager: error loading user index for %s: %s\n",
+				userID, err)
+		}
+		entries = nil
+	}
+	now := time.Now()
+	live := make([]indexedToken, 0, len(entries)+1)
+	for _, entry := range entries {
+		if now.Before(time.Unix(entry.Expiration, 0)) {
+			live = append(live, entry)
+		}
+	}
+	live = append(live, indexedToken{
+		Hash:       hash,
+		Kind:       kind,
+		Expiration: expiration.Unix(),
+	})
+	if err := saveUserIndex(m.storage, userID, live); err != nil && m.logger != nil {
+		m.logger.Printf("tokenmanager: error saving user index for %s: %s\n",
+			userID, err)
+	}
+}
+
+func (m *Manager) create(userID string, kind Kind, ttl time.Duration) (
+	token string, err error) {
+	token, err = newToken()
+	if err != nil {
+		return "", err
+	}
+	hash := hashToken(token)
+	expiration := time.Now().Add(ttl)
+	if err := m.storage.UpsertSigned(hash, dataType(kind), expiration.Unix(),
+		[]byte(userID)); err != nil {
+		return "", err
+	}
+	m.rwMutex.Lock()
+	m.index[hash] = tokenIndexEntry{
+		userID:     userID,
+		kind:       kind,
+		expiration: expiration,
+	}
+	if m.userTokens[userID] == nil {
+		m.userTokens[userID] = make(map[string]struct{})
+	}
+	m.userTokens[userID][hash] = struct{}{}
+	m.rwMutex.Unlock()
+	m.addToUserIndex(userID, hash, kind, expiration)
+	go m.sweepExpired()
+	return token, nil
+}
+
+func (m *Manager) check(token string, kind Kind) (userID string, ok bool) {
+	hash := hashToken(token)
+	found, data, err := m.storage.GetSigned(hash, dataType(kind))
+	if err != nil || !found {
+		return "", false
+	}
+	return string(data), true
+}
+
+// delete removes token from storage under both kinds: a hash collision
+// between a session and a CSRF token is practically impossible, and this
+// lets Delete work even for tokens issued before this process started, when
+// the in-memory index has no record of which kind the token was.
+func (m *Manager) delete(token string) error {
+	hash := hashToken(token)
+	m.forgetHash(hash)
+	var firstErr error
+	if err := m.storage.DeleteSigned(hash, dataType(Session)); err != nil {
+		firstErr = err
+	}
+	if err := m.storage.DeleteSigned(hash, dataType(CSRF)); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func (m *Manager) forgetHash(hash string) {
+	m.rwMutex.Lock()
+	entry, ok := m.index[hash]
+	delete(m.index, hash)
+	if ok {
+		delete(m.userTokens[entry.userID], hash)
+	}
+	m.rwMutex.Unlock()
+}
+
+// deleteAllForUser invalidates every token storage still has on record for
+// userID, not just the ones this process happens to have created: the
+// in-memory userTokens map only covers tokens issued since the last
+// restart, so it is merged with the durable per-user index saved by
+// addToUserIndex before anything is deleted from storage.
+func (m *Manager) deleteAllForUser(userID string) error {
+	m.rwMutex.Lock()
+	entries := make(map[string]Kind, len(m.userTokens[userID]))
+	for hash := range m.userTokens[userID] {
+		entries[hash] = m.index[hash].kind
+		delete(m.index, hash)
+	}
+	delete(m.userTokens, userID)
+	m.rwMutex.Unlock()
+	durable, err := loadUserIndex(m.storage, userID)
+	if err != nil && m.logger != nil {
+		m.logger.Printf("tokenmanager: error loading user index for %s: %s\n",
+			userID, err)
+	}
+	for _, entry := range durable {
+		entries[entry.Hash] = entry.Kind
+	}
+	var firstErr error
+	for hash, kind := range entries {
+		if err := m.storage.DeleteSigned(hash, dataType(kind)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := m.storage.DeleteSigned(userIndexKey(userID), userIndexDataType); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func (m *Manager) sweepLoop() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.sweepExpired()
+		case <-m.closeChannel:
+			return
+		}
+	}
+}
+
+// sweepExpired deletes entries the index knows have expired. Only tokens
+// created since this process started are tracked in the index, so this is
+// a best-effort cleanup: storage.GetSigned is expected to treat a record
+// past its own expiration as absent regardless of whether it was ever
+// swept here.
+func (m *Manager) sweepExpired() {
+	now := time.Now()
+	m.rwMutex.Lock()
+	var expired []string
+	for hash, entry := range m.index {
+		if now.After(entry.expiration) {
+			expired = append(expired, hash)
+		}
+	}
+	kinds := make(map[string]Kind, len(expired))
+	for _, hash := range expired {
+		entry := m.index[hash]
+		kinds[hash] = entry.kind
+		delete(m.index, hash)
+		delete(m.userTokens[entry.userID], hash)
+	}
+	m.rwMutex.Unlock()
+	for _, hash := range expired {
+		if err := m.storage.DeleteSigned(hash, dataType(kinds[hash])); err != nil && m.logger != nil {
+			m.logger.Printf("tokenmanager: error deleting expired token: %s\n", err)
+		}
+	}
+}
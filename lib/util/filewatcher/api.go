@@ -0,0 +1,43 @@
+package filewatcher
+
+import (
+	"time"
+
+	"github.com/Symantec/Dominator/lib/log"
+)
+
+const DefaultPollInterval = time.Second * 15
+
+// ReloadFunc is called whenever the watched file changes; if no filesystem
+// watch could be installed, it is called when periodic polling finds the
+// file's mtime has advanced. Implementations
+// should be idempotent: on error they should leave any previously loaded
+// state untouched and just report the error.
+type ReloadFunc func() error
+
+// Watcher watches a single file for changes and invokes a ReloadFunc
+// whenever the file is created, written to, or renamed into place. If an
+// inotify watch cannot be installed (NFS mounts, some container runtimes
+// with bind-mounted secrets) it transparently falls back to polling the
+// file's mtime every pollInterval.
+type Watcher struct {
+	filename     string
+	pollInterval time.Duration
+	reload       ReloadFunc
+	logger       log.DebugLogger
+	closeChannel chan struct{}
+}
+
+// New starts watching filename in the background and returns immediately.
+// It does not call reload itself; the caller is expected to load the
+// initial state before calling New, reload is only invoked for subsequent
+// changes. If pollInterval is zero, DefaultPollInterval is used.
+func New(filename string, pollInterval time.Duration, reload ReloadFunc,
+	logger log.DebugLogger) (*Watcher, error) {
+	return newWatcher(filename, pollInterval, reload, logger)
+}
+
+// Close stops the watcher goroutine and releases any underlying resources.
+func (w *Watcher) Close() error {
+	return w.close()
+}
@@ -0,0 +1,114 @@
+package filewatcher
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Symantec/Dominator/lib/log"
+	"gopkg.in/fsnotify.v1"
+)
+
+func newWatcher(filename string, pollInterval time.Duration,
+	reload ReloadFunc, logger log.DebugLogger) (*Watcher, error) {
+	if pollInterval <= 0 {
+		pollInterval = DefaultPollInterval
+	}
+	w := &Watcher{
+		filename:     filename,
+		pollInterval: pollInterval,
+		reload:       reload,
+		logger:       logger,
+		closeChannel: make(chan struct{}),
+	}
+	notifyWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		if logger != nil {
+			logger.Printf("filewatcher: fsnotify unavailable, falling back to polling %s every %s: %s\n",
+				filename, pollInterval, err)
+		}
+		go w.pollLoop()
+		return w, nil
+	}
+	// Watch the parent directory, not filename itself: fsnotify watches
+	// inodes, and an atomic rename-into-place (the standard way bind-mounted
+	// secrets, fsutil.CreateRenamingWriter-style writers, and htpasswd
+	// editors update a file) replaces filename's inode, which would
+	// otherwise orphan a watch on the old, now-unlinked file and leave it
+	// silently dead until process restart.
+	dir := filepath.Dir(filename)
+	if err := notifyWatcher.Add(dir); err != nil {
+		notifyWatcher.Close()
+		if logger != nil {
+			logger.Printf("filewatcher: cannot watch %s, falling back to polling every %s: %s\n",
+				dir, pollInterval, err)
+		}
+		go w.pollLoop()
+		return w, nil
+	}
+	go w.watchLoop(notifyWatcher)
+	return w, nil
+}
+
+func (w *Watcher) watchLoop(notifyWatcher *fsnotify.Watcher) {
+	defer notifyWatcher.Close()
+	base := filepath.Base(w.filename)
+	for {
+		select {
+		case event, ok := <-notifyWatcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Base(event.Name) != base {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				w.triggerReload()
+			}
+		case err, ok := <-notifyWatcher.Errors:
+			if !ok {
+				return
+			}
+			if w.logger != nil {
+				w.logger.Printf("filewatcher: error watching %s: %s\n", w.filename, err)
+			}
+		case <-w.closeChannel:
+			return
+		}
+	}
+}
+
+func (w *Watcher) pollLoop() {
+	var lastModTime time.Time
+	if info, err := os.Stat(w.filename); err == nil {
+		lastModTime = info.ModTime()
+	}
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(w.filename)
+			if err != nil {
+				continue
+			}
+			if info.ModTime().After(lastModTime) {
+				lastModTime = info.ModTime()
+				w.triggerReload()
+			}
+		case <-w.closeChannel:
+			return
+		}
+	}
+}
+
+func (w *Watcher) triggerReload() {
+	if err := w.reload(); err != nil && w.logger != nil {
+		w.logger.Printf("filewatcher: error reloading %s: %s\n", w.filename, err)
+	}
+}
+
+func (w *Watcher) close() error {
+	close(w.closeChannel)
+	return nil
+}